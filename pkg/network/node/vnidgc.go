@@ -0,0 +1,67 @@
+package node
+
+import (
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// vnidGCPeriod is how often the reconciler re-scans for stale per-VNID
+// flow rules even if no add/update/delete event fired in the meantime.
+const vnidGCPeriod = 5 * time.Minute
+
+// vnidGC periodically reconciles the OVS per-VNID flow rules the policy
+// plugin has installed against the VNIDs that are actually still in use
+// (nodeVNIDMap.InUseVNIDs). It runs on a timer and on demand after every
+// VNID add/update/delete, so a missed or reordered NetNamespace event can
+// no longer leak a flow rule or have one removed prematurely -- the next
+// reconcile pass always converges on the true state.
+type vnidGC struct {
+	vmap   *nodeVNIDMap
+	policy osdnPolicy
+
+	// reconcileCh is signalled after every add/update/delete so the GC
+	// also runs on demand instead of waiting out the full period.
+	reconcileCh chan struct{}
+}
+
+func newVNIDGC(vmap *nodeVNIDMap, policy osdnPolicy) *vnidGC {
+	return &vnidGC{
+		vmap:        vmap,
+		policy:      policy,
+		reconcileCh: make(chan struct{}, 1),
+	}
+}
+
+// Requeue schedules a reconcile pass without blocking the caller.
+func (gc *vnidGC) Requeue() {
+	select {
+	case gc.reconcileCh <- struct{}{}:
+	default:
+	}
+}
+
+// Run reconciles once immediately and then on every tick or Requeue until
+// stopCh is closed. It is meant to be run in its own goroutine.
+func (gc *vnidGC) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(vnidGCPeriod)
+	defer ticker.Stop()
+
+	for {
+		gc.reconcile()
+
+		select {
+		case <-ticker.C:
+		case <-gc.reconcileCh:
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (gc *vnidGC) reconcile() {
+	inUse := gc.vmap.InUseVNIDs()
+	if err := gc.policy.ReconcileVNIDFlows(inUse); err != nil {
+		klog.Warningf("Failed to reconcile per-VNID flow rules: %v", err)
+	}
+}
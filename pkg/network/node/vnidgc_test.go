@@ -0,0 +1,66 @@
+package node
+
+import "testing"
+
+// TestInUseVNIDsConvergesWithoutEvents exercises the property chunk0-1 was
+// built for: InUseVNIDs recomputes from the current state on every call
+// instead of trusting an incrementally-maintained refcount, so it can
+// never drift even if the caller never hears about a change (e.g. a local
+// pod going away without a corresponding NetNamespace event).
+func TestInUseVNIDsConvergesWithoutEvents(t *testing.T) {
+	vmap := newNodeVNIDMap(&fakePolicy{}, nil, "")
+	vmap.setVNID("ns1", 10, false)
+
+	var podVNIDs []uint32
+	vmap.RegisterUsageSource(func() []uint32 { return podVNIDs })
+
+	if inUse := vmap.InUseVNIDs(); inUse[20] {
+		t.Fatalf("expected VNID 20 not to be in use yet, got %v", inUse)
+	}
+
+	podVNIDs = []uint32{20}
+	inUse := vmap.InUseVNIDs()
+	if !inUse[10] || !inUse[20] {
+		t.Fatalf("expected VNIDs 10 and 20 to be in use, got %v", inUse)
+	}
+
+	// The pod that was using VNID 20 goes away; no NetNamespace event fires
+	// for this, but the next reconcile pass still converges immediately
+	// because InUseVNIDs doesn't rely on being told.
+	podVNIDs = nil
+	if inUse = vmap.InUseVNIDs(); inUse[20] {
+		t.Fatalf("expected VNID 20 to no longer be in use, got %v", inUse)
+	}
+}
+
+func TestGCReconcileCallsPolicyWithInUseVNIDs(t *testing.T) {
+	policy := &fakePolicy{}
+	vmap := newNodeVNIDMap(policy, nil, "")
+	vmap.setVNID("ns1", 10, false)
+
+	gc := newVNIDGC(vmap, policy)
+	gc.reconcile()
+
+	if !policy.reconciledInUse[10] {
+		t.Fatalf("expected ReconcileVNIDFlows to be called with VNID 10 in use, got %v", policy.reconciledInUse)
+	}
+
+	if _, err := vmap.unsetVNID("ns1"); err != nil {
+		t.Fatalf("unsetVNID: %v", err)
+	}
+	gc.reconcile()
+	if policy.reconciledInUse[10] {
+		t.Fatalf("expected VNID 10 to no longer be reconciled as in-use, got %v", policy.reconciledInUse)
+	}
+}
+
+func TestGCRequeueIsNonBlocking(t *testing.T) {
+	vmap := newNodeVNIDMap(&fakePolicy{}, nil, "")
+	gc := newVNIDGC(vmap, &fakePolicy{})
+
+	// Requeue must never block the setVNID/unsetVNID caller, even if
+	// nothing is draining reconcileCh yet.
+	for i := 0; i < 10; i++ {
+		gc.Requeue()
+	}
+}
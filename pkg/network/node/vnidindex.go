@@ -0,0 +1,100 @@
+package node
+
+import (
+	"sync"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// IndexFunc computes the index keys a namespace's VNID entry maps to for
+// a given named index. It's modeled after k8s.io/client-go/tools/cache's
+// IndexFunc/Indexers, but keyed on the (name, netid, mcEnabled) triple
+// nodeVNIDMap already tracks rather than an arbitrary object.
+type IndexFunc func(name string, netID uint32, mcEnabled bool) []string
+
+// mcEnabledIndexName indexes namespaces by whether multicast is enabled on
+// them, so "all multicast-enabled namespaces" is a single ByIndex lookup
+// instead of a scan.
+const mcEnabledIndexName = "mcEnabled"
+
+func mcEnabledIndexFunc(_ string, _ uint32, mcEnabled bool) []string {
+	if !mcEnabled {
+		return nil
+	}
+	return []string{"true"}
+}
+
+// byNetIDRange and byLabelSelector are natural additions to this indexer
+// (a coarse NetID bucket, and namespace labels once they're cached locally
+// from the Namespace informer) but aren't added until something actually
+// calls ByIndex with them -- an index nothing queries is just unindexed
+// maintenance overhead on every setVNID/unsetVNID.
+
+// vnidIndexer maintains the reverse indices (index name -> key ->
+// namespace names) that let callers look up namespaces by something other
+// than name or VNID without scanning the whole map under a lock.
+type vnidIndexer struct {
+	mu       sync.Mutex
+	indexers map[string]IndexFunc
+	indices  map[string]map[string]sets.String
+}
+
+func newVNIDIndexer(indexers map[string]IndexFunc) *vnidIndexer {
+	indices := make(map[string]map[string]sets.String, len(indexers))
+	for name := range indexers {
+		indices[name] = make(map[string]sets.String)
+	}
+	return &vnidIndexer{
+		indexers: indexers,
+		indices:  indices,
+	}
+}
+
+// update re-indexes name under its current (netID, mcEnabled) values,
+// replacing whatever it was previously indexed under.
+func (idx *vnidIndexer) update(name string, netID uint32, mcEnabled bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.removeLocked(name)
+	for indexName, fn := range idx.indexers {
+		for _, key := range fn(name, netID, mcEnabled) {
+			set, ok := idx.indices[indexName][key]
+			if !ok {
+				set = sets.NewString()
+				idx.indices[indexName][key] = set
+			}
+			set.Insert(name)
+		}
+	}
+}
+
+// remove drops name from every index.
+func (idx *vnidIndexer) remove(name string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.removeLocked(name)
+}
+
+func (idx *vnidIndexer) removeLocked(name string) {
+	for indexName, keys := range idx.indices {
+		for key, set := range keys {
+			set.Delete(name)
+			if set.Len() == 0 {
+				delete(idx.indices[indexName], key)
+			}
+		}
+	}
+}
+
+// byIndex returns the de-duplicated namespace names registered under key
+// in the named index.
+func (idx *vnidIndexer) byIndex(indexName, key string) []string {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	set, ok := idx.indices[indexName][key]
+	if !ok {
+		return nil
+	}
+	return set.List()
+}
@@ -0,0 +1,138 @@
+package node
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestVNIDIndexerUpdateAndRemove(t *testing.T) {
+	idx := newVNIDIndexer(map[string]IndexFunc{
+		mcEnabledIndexName: mcEnabledIndexFunc,
+	})
+
+	idx.update("ns1", 10, true)
+	idx.update("ns2", 20, true)
+	idx.update("ns3", 30, false)
+
+	got := idx.byIndex(mcEnabledIndexName, "true")
+	sort.Strings(got)
+	if want := []string{"ns1", "ns2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("byIndex(mcEnabled, true) = %v, want %v", got, want)
+	}
+
+	// Flipping ns1's mcEnabled value must move it out of the index, not
+	// just add it again under a stale entry.
+	idx.update("ns1", 10, false)
+	got = idx.byIndex(mcEnabledIndexName, "true")
+	if want := []string{"ns2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("byIndex(mcEnabled, true) after update = %v, want %v", got, want)
+	}
+
+	idx.remove("ns2")
+	if got := idx.byIndex(mcEnabledIndexName, "true"); len(got) != 0 {
+		t.Fatalf("byIndex(mcEnabled, true) after remove = %v, want empty", got)
+	}
+}
+
+func TestGetMulticastEnabledUsesIndex(t *testing.T) {
+	vmap := newNodeVNIDMap(&fakePolicy{allowDuplicateNetID: true}, nil, "")
+
+	vmap.setVNID("ns1", 10, true)
+	vmap.setVNID("ns2", 10, true)
+	if !vmap.GetMulticastEnabled(10) {
+		t.Fatalf("expected VNID 10 to be multicast-enabled")
+	}
+
+	// One of the two namespaces sharing this VNID turning multicast off
+	// means the VNID as a whole is no longer multicast-enabled.
+	vmap.setVNID("ns2", 10, false)
+	if vmap.GetMulticastEnabled(10) {
+		t.Fatalf("expected VNID 10 to no longer be multicast-enabled once ns2 disabled it")
+	}
+}
+
+func TestSetVNIDRejectsDuplicateNetID(t *testing.T) {
+	vmap := newNodeVNIDMap(&fakePolicy{}, nil, "")
+
+	if _, rejected := vmap.setVNID("ns1", 10, false); rejected {
+		t.Fatalf("expected first setVNID for netid 10 to succeed")
+	}
+	owner, rejected := vmap.setVNID("ns2", 10, false)
+	if !rejected || owner != "ns1" {
+		t.Fatalf("expected setVNID for ns2 to be rejected in favor of ns1, got owner=%q rejected=%v", owner, rejected)
+	}
+
+	if id, err := vmap.getVNID("ns2"); err == nil {
+		t.Fatalf("expected ns2 to have no VNID after rejection, got %d", id)
+	}
+}
+
+func TestSetVNIDAllowsDuplicateNetIDWhenPolicyOptsIn(t *testing.T) {
+	policy := &fakePolicy{allowDuplicateNetID: true}
+	vmap := newNodeVNIDMap(policy, nil, "")
+
+	if _, rejected := vmap.setVNID("ns1", 10, false); rejected {
+		t.Fatalf("expected first setVNID for netid 10 to succeed")
+	}
+	if _, rejected := vmap.setVNID("ns2", 10, false); rejected {
+		t.Fatalf("expected setVNID for ns2 to succeed when AllowDuplicateNetID is true")
+	}
+
+	got := vmap.GetNamespaces(10)
+	sort.Strings(got)
+	if want := []string{"ns1", "ns2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("GetNamespaces(10) = %v, want %v", got, want)
+	}
+}
+
+// TestConcurrentSetUnsetKeepsIndexInSyncWithNamespaces is a regression test
+// for the index/namespace desync race: a concurrent unsetVNID for a name's
+// old VNID used to run its indexer.remove outside the nsLock critical
+// section that a racing setVNID for the same name uses to add it back
+// under a new VNID, so the stale remove could wipe the name from the
+// index for good even though vmap.namespaces still (correctly) lists it.
+// indexer.update/remove now happen inside the same nsLock section as the
+// vmap.namespaces mutation they mirror, so the two can never disagree.
+func TestConcurrentSetUnsetKeepsIndexInSyncWithNamespaces(t *testing.T) {
+	vmap := newNodeVNIDMap(&fakePolicy{}, nil, "")
+
+	const names = 8
+	const iterations = 500
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				name := fmt.Sprintf("ns%d", (g+i)%names)
+				id := uint32(i%2)*10 + 10 // 10 or 20
+				vmap.setVNID(name, id, true)
+				if i%3 == 0 {
+					vmap.unsetVNID(name)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// Whatever the final state settled to, every namespace the map still
+	// tracks as multicast-enabled must also be in the mcEnabled index, and
+	// vice versa: the two data structures must never disagree.
+	for _, name := range vmap.knownNames() {
+		mcEnabled := vmap.getMCEnabled(name)
+		inIndex := false
+		for _, indexed := range vmap.ByIndex(mcEnabledIndexName, "true") {
+			if indexed == name {
+				inIndex = true
+				break
+			}
+		}
+		if mcEnabled != inIndex {
+			t.Fatalf("namespace %q: getMCEnabled=%v but mcEnabled index membership=%v", name, mcEnabled, inIndex)
+		}
+	}
+}
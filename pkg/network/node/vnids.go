@@ -3,12 +3,14 @@ package node
 import (
 	"context"
 	"fmt"
+	"hash/fnv"
 	"sync"
 	"time"
 
 	"k8s.io/klog/v2"
 
 	metrics "github.com/openshift/sdn/pkg/network/node/metrics"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/sets"
 	utilwait "k8s.io/apimachinery/pkg/util/wait"
@@ -20,26 +22,125 @@ import (
 	"github.com/openshift/sdn/pkg/network/common"
 )
 
+// vnidMapShardCount controls how many independent ids/mcEnabled maps the
+// VNID map is split into. Namespace names are hashed to a shard, so
+// concurrent setVNID/getVNID calls for different namespaces only contend
+// if they happen to land in the same shard.
+const vnidMapShardCount = 32
+
+// vnidMapShard holds one slice of the name -> (netid, mcEnabled) mapping,
+// guarded by its own lock.
+type vnidMapShard struct {
+	mu        sync.RWMutex
+	ids       map[string]uint32
+	mcEnabled map[string]bool
+}
+
 type nodeVNIDMap struct {
 	policy        osdnPolicy
 	osdnClient    osdnclient.Interface
 	osdnInformers osdninformers.SharedInformerFactory
 
-	// Synchronizes add or remove ids/namespaces
-	lock       sync.Mutex
-	ids        map[string]uint32
-	mcEnabled  map[string]bool
+	shards []*vnidMapShard
+
+	// nsLock guards the VNID -> namespace-set reverse index. It's taken
+	// for the whole duplicate-check-then-write sequence in setVNID so that
+	// check and write happen atomically, but is otherwise only ever held
+	// for the short time it takes to update that one index.
+	nsLock     sync.Mutex
 	namespaces map[uint32]sets.String
+
+	// usageSources report additional, non-NetNamespace reasons a VNID may
+	// be in use (local pods with an assigned netns, services, ...). They
+	// are consulted by InUseVNIDs and the GC reconciler.
+	usageSourcesLock sync.Mutex
+	usageSources     []VNIDUsageSource
+
+	// indexer maintains secondary lookups (e.g. "all multicast-enabled
+	// namespaces") that would otherwise require scanning every shard.
+	indexer *vnidIndexer
+
+	gc     *vnidGC
+	stopCh chan struct{}
+
+	// cachePath is where the VNID map is persisted to disk, if runDir was
+	// set when the map was created. Empty disables the cache.
+	cachePath    string
+	cacheDirtyCh chan struct{}
 }
 
-func newNodeVNIDMap(policy osdnPolicy, osdnClient osdnclient.Interface) *nodeVNIDMap {
-	return &nodeVNIDMap{
+func newNodeVNIDMap(policy osdnPolicy, osdnClient osdnclient.Interface, runDir string) *nodeVNIDMap {
+	shards := make([]*vnidMapShard, vnidMapShardCount)
+	for i := range shards {
+		shards[i] = &vnidMapShard{
+			ids:       make(map[string]uint32),
+			mcEnabled: make(map[string]bool),
+		}
+	}
+
+	vmap := &nodeVNIDMap{
 		policy:     policy,
 		osdnClient: osdnClient,
-		ids:        make(map[string]uint32),
-		mcEnabled:  make(map[string]bool),
+		shards:     shards,
 		namespaces: make(map[uint32]sets.String),
+		indexer: newVNIDIndexer(map[string]IndexFunc{
+			mcEnabledIndexName: mcEnabledIndexFunc,
+		}),
+		stopCh: make(chan struct{}),
+	}
+	if runDir != "" {
+		vmap.cachePath = vnidCachePath(runDir)
+		vmap.cacheDirtyCh = make(chan struct{}, 1)
+	}
+	return vmap
+}
+
+// shardFor returns the shard responsible for the given namespace name.
+func (vmap *nodeVNIDMap) shardFor(name string) *vnidMapShard {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return vmap.shards[h.Sum32()%uint32(len(vmap.shards))]
+}
+
+// VNIDUsageSource reports the VNIDs that some local resource (pods,
+// services, ...) currently depends on having OVS per-VNID flow rules for.
+// It lets the GC reconciler see usage that the VNID map itself doesn't
+// track.
+type VNIDUsageSource func() []uint32
+
+// RegisterUsageSource adds a source of local VNID usage that the GC
+// reconciler consults in addition to the known NetNamespace objects.
+func (vmap *nodeVNIDMap) RegisterUsageSource(source VNIDUsageSource) {
+	vmap.usageSourcesLock.Lock()
+	defer vmap.usageSourcesLock.Unlock()
+	vmap.usageSources = append(vmap.usageSources, source)
+}
+
+// InUseVNIDs returns every VNID that currently has a reason to have
+// OVS per-VNID flow rules installed: a known NetNamespace, plus anything
+// reported by a registered usage source (local pods with an assigned
+// netns, services, ...). It replaces the old refcount-on-namespace-set
+// bookkeeping as the source of truth for the GC reconciler, so a missed
+// or reordered NetNamespace event can no longer leak or prematurely drop
+// a flow.
+func (vmap *nodeVNIDMap) InUseVNIDs() map[uint32]bool {
+	vmap.nsLock.Lock()
+	inUse := make(map[uint32]bool, len(vmap.namespaces))
+	for vnid := range vmap.namespaces {
+		inUse[vnid] = true
+	}
+	vmap.nsLock.Unlock()
+
+	vmap.usageSourcesLock.Lock()
+	sources := append([]VNIDUsageSource{}, vmap.usageSources...)
+	vmap.usageSourcesLock.Unlock()
+
+	for _, source := range sources {
+		for _, vnid := range source() {
+			inUse[vnid] = true
+		}
 	}
+	return inUse
 }
 
 func (vmap *nodeVNIDMap) addNamespaceToSet(name string, vnid uint32) {
@@ -61,8 +162,8 @@ func (vmap *nodeVNIDMap) removeNamespaceFromSet(name string, vnid uint32) {
 }
 
 func (vmap *nodeVNIDMap) GetNamespaces(id uint32) []string {
-	vmap.lock.Lock()
-	defer vmap.lock.Unlock()
+	vmap.nsLock.Lock()
+	defer vmap.nsLock.Unlock()
 
 	if set, ok := vmap.namespaces[id]; ok {
 		return set.List()
@@ -72,21 +173,26 @@ func (vmap *nodeVNIDMap) GetNamespaces(id uint32) []string {
 }
 
 func (vmap *nodeVNIDMap) GetMulticastEnabled(id uint32) bool {
-	vmap.lock.Lock()
-	defer vmap.lock.Unlock()
-
-	set, exists := vmap.namespaces[id]
-	if !exists || set.Len() == 0 {
+	names := vmap.GetNamespaces(id)
+	if len(names) == 0 {
 		return false
 	}
-	for _, ns := range set.List() {
-		if !vmap.mcEnabled[ns] {
+	mcEnabled := sets.NewString(vmap.ByIndex(mcEnabledIndexName, "true")...)
+	for _, ns := range names {
+		if !mcEnabled.Has(ns) {
 			return false
 		}
 	}
 	return true
 }
 
+// ByIndex returns the de-duplicated namespace names registered under key
+// in the named index, e.g. ByIndex(mcEnabledIndexName, "true") for every
+// multicast-enabled namespace. It never scans the full map.
+func (vmap *nodeVNIDMap) ByIndex(indexName, key string) []string {
+	return vmap.indexer.byIndex(indexName, key)
+}
+
 // Nodes asynchronously watch for both NetNamespaces and services
 // NetNamespaces populates vnid map and services/pod-setup depend on vnid map
 // If for some reason, vnid map propagation from master to node is slow
@@ -125,56 +231,112 @@ func (vmap *nodeVNIDMap) WaitAndGetVNID(name string) (uint32, error) {
 }
 
 func (vmap *nodeVNIDMap) getVNID(name string) (uint32, error) {
-	vmap.lock.Lock()
-	defer vmap.lock.Unlock()
+	shard := vmap.shardFor(name)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
 
-	if id, ok := vmap.ids[name]; ok {
+	if id, ok := shard.ids[name]; ok {
 		return id, nil
 	}
 	return 0, fmt.Errorf("failed to find netid for namespace: %s in vnid map", name)
 }
 
-func (vmap *nodeVNIDMap) findDuplicateNetID(namespace string, netID uint32) (string, bool) {
-	// Need to prevent duplicate NetID only for networkpolicy mode
-	if vmap.policy.AllowDuplicateNetID() {
-		return "", false
+func (vmap *nodeVNIDMap) getMCEnabled(name string) bool {
+	shard := vmap.shardFor(name)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	return shard.mcEnabled[name]
+}
+
+// count returns the total number of namespaces currently tracked, across
+// all shards.
+func (vmap *nodeVNIDMap) count() int {
+	n := 0
+	for _, shard := range vmap.shards {
+		shard.mu.RLock()
+		n += len(shard.ids)
+		shard.mu.RUnlock()
 	}
+	return n
+}
 
-	names := vmap.GetNamespaces(netID)
-	for _, name := range names {
-		if name != namespace {
-			return name, true
+// setVNID associates id with name, rejecting the change if another
+// namespace already owns id (in modes that disallow duplicate NetIDs). The
+// duplicate check and the write are performed under the same nsLock
+// critical section, so a concurrent setVNID for a different namespace can
+// never observe, or create, a stale view of which namespace owns a VNID.
+func (vmap *nodeVNIDMap) setVNID(name string, id uint32, mcEnabled bool) (duplicate string, rejected bool) {
+	shard := vmap.shardFor(name)
+
+	vmap.nsLock.Lock()
+	if !vmap.policy.AllowDuplicateNetID() {
+		for _, other := range vmap.namespaces[id].List() {
+			if other != name {
+				vmap.nsLock.Unlock()
+				return other, true
+			}
 		}
 	}
-	return "", false
-}
 
-func (vmap *nodeVNIDMap) setVNID(name string, id uint32, mcEnabled bool) {
-	vmap.lock.Lock()
-	defer vmap.lock.Unlock()
+	shard.mu.Lock()
+	oldId, hadOld := shard.ids[name]
+	shard.ids[name] = id
+	shard.mcEnabled[name] = mcEnabled
+	shard.mu.Unlock()
 
-	if oldId, found := vmap.ids[name]; found {
+	if hadOld {
 		vmap.removeNamespaceFromSet(name, oldId)
 	}
-	vmap.ids[name] = id
-	vmap.mcEnabled[name] = mcEnabled
 	vmap.addNamespaceToSet(name, id)
+	// indexer.update is kept inside the same nsLock critical section as the
+	// vmap.namespaces update it mirrors, so a concurrent unsetVNID for this
+	// name can never interleave between the two and leave them disagreeing
+	// about which VNID (or whether any VNID) the name is indexed under.
+	vmap.indexer.update(name, id, mcEnabled)
+	vmap.nsLock.Unlock()
 
 	klog.V(4).Infof("Associate netid %d to namespace %q with mcEnabled %v", id, name, mcEnabled)
+
+	if vmap.gc != nil {
+		vmap.gc.Requeue()
+	}
+	vmap.saveCache()
+	return "", false
 }
 
 func (vmap *nodeVNIDMap) unsetVNID(name string) (id uint32, err error) {
-	vmap.lock.Lock()
-	defer vmap.lock.Unlock()
+	shard := vmap.shardFor(name)
+
+	// The shard delete happens under nsLock too, as in setVNID, so a
+	// concurrent setVNID for this name can't re-add it in between and then
+	// have its index and reverse-index entries removed by this call.
+	vmap.nsLock.Lock()
+	shard.mu.Lock()
+	id, found := shard.ids[name]
+	if found {
+		delete(shard.ids, name)
+		delete(shard.mcEnabled, name)
+	}
+	shard.mu.Unlock()
 
-	id, found := vmap.ids[name]
 	if !found {
+		vmap.nsLock.Unlock()
 		return 0, fmt.Errorf("failed to find netid for namespace: %s in vnid map", name)
 	}
+
 	vmap.removeNamespaceFromSet(name, id)
-	delete(vmap.ids, name)
-	delete(vmap.mcEnabled, name)
+	// See the matching comment in setVNID: kept inside the same critical
+	// section as the vmap.namespaces removal so the two can't be reordered
+	// against a concurrent setVNID for this name.
+	vmap.indexer.remove(name)
+	vmap.nsLock.Unlock()
+
 	klog.V(4).Infof("Dissociate netid %d from namespace %q", id, name)
+
+	if vmap.gc != nil {
+		vmap.gc.Requeue()
+	}
+	vmap.saveCache()
 	return id, nil
 }
 
@@ -183,14 +345,48 @@ func netnsIsMulticastEnabled(netns *osdnv1.NetNamespace) bool {
 	return enabled == "true" && ok
 }
 
+// knownNames returns the namespace names currently tracked, across all
+// shards. Used by populateVNIDs to find cache-seeded entries that the
+// fresh List no longer knows about.
+func (vmap *nodeVNIDMap) knownNames() []string {
+	var names []string
+	for _, shard := range vmap.shards {
+		shard.mu.RLock()
+		for name := range shard.ids {
+			names = append(names, name)
+		}
+		shard.mu.RUnlock()
+	}
+	return names
+}
+
 func (vmap *nodeVNIDMap) populateVNIDs() error {
 	nets, err := vmap.osdnClient.NetworkV1().NetNamespaces().List(context.TODO(), metav1.ListOptions{})
 	if err != nil {
 		return err
 	}
 
+	listed := sets.NewString()
 	for _, net := range nets.Items {
-		vmap.setVNID(net.Name, net.NetID, netnsIsMulticastEnabled(&net))
+		listed.Insert(net.Name)
+		if owner, rejected := vmap.setVNID(net.Name, net.NetID, netnsIsMulticastEnabled(&net)); rejected {
+			klog.Warningf("Netid %d for namespace %s already exists under different namespace %s",
+				net.NetID, net.Name, owner)
+		}
+	}
+
+	// Anything still tracked (e.g. seeded from the on-disk cache) that the
+	// fresh List no longer knows about was deleted while we were
+	// disconnected; the informer's own store starts empty, so it will
+	// never deliver a Delete event for it. Unset it here so it doesn't
+	// linger forever and keep InUseVNIDs/the GC reconciler from ever
+	// cleaning up its flow rule.
+	for _, name := range vmap.knownNames() {
+		if !listed.Has(name) {
+			if _, err := vmap.unsetVNID(name); err != nil {
+				klog.Warningf("Failed to reconcile stale cached VNID entry for namespace %q: %v", name, err)
+			}
+		}
 	}
 	return nil
 }
@@ -198,10 +394,25 @@ func (vmap *nodeVNIDMap) populateVNIDs() error {
 func (vmap *nodeVNIDMap) Start(osdnInformers osdninformers.SharedInformerFactory) error {
 	vmap.osdnInformers = osdnInformers
 
+	// Seed from the on-disk cache first so getVNID can succeed immediately,
+	// even if the apiserver LIST below is slow or unreachable (e.g. right
+	// after a node reboot). The informer sync that follows reconciles and
+	// overwrites this seeded state once it completes.
+	vmap.loadCache()
+
 	// Populate vnid map synchronously so that existing services can fetch vnid
-	err := vmap.populateVNIDs()
-	if err != nil {
-		return err
+	if err := vmap.populateVNIDs(); err != nil {
+		if vmap.count() == 0 {
+			return err
+		}
+		klog.Warningf("Failed to list NetNamespaces from API server, falling back to cached VNID map: %v", err)
+	}
+
+	vmap.gc = newVNIDGC(vmap, vmap.policy)
+	go vmap.gc.Run(vmap.stopCh)
+
+	if vmap.cacheDirtyCh != nil {
+		go vmap.runCacheWriter(vmap.stopCh)
 	}
 
 	vmap.watchNetNamespaces()
@@ -217,21 +428,28 @@ func (vmap *nodeVNIDMap) handleAddOrUpdateNetNamespace(obj, _ interface{}, event
 	netns := obj.(*osdnv1.NetNamespace)
 	klog.V(5).Infof("Watch %s event for NetNamespace %q", eventType, netns.Name)
 
-	// Skip this event if NetID already exists under different netns name
-	if name, found := vmap.findDuplicateNetID(netns.NetName, netns.NetID); found == true {
-		klog.Warningf("Netid %d for namespace %s already exists under different namespace %s",
-			netns.NetID, netns.NetName, name)
-		return
-	}
+	// The change-pod-network annotation is set on an existing NetNamespace
+	// without touching its NetID or multicast flag, so it must be checked
+	// independently of the "nothing has changed" guard below -- otherwise
+	// the one event that carries it is exactly the one that guard skips.
+	vmap.handleChangePodNetworkAnnotation(netns)
 
-	// Skip this event if nothing has changed
+	// Skip the VNID bookkeeping below if nothing else has changed
 	oldNetID, err := vmap.getVNID(netns.NetName)
-	oldMCEnabled := vmap.mcEnabled[netns.NetName]
+	oldMCEnabled := vmap.getMCEnabled(netns.NetName)
 	mcEnabled := netnsIsMulticastEnabled(netns)
 	if err == nil && oldNetID == netns.NetID && oldMCEnabled == mcEnabled {
 		return
 	}
-	vmap.setVNID(netns.NetName, netns.NetID, mcEnabled)
+
+	// setVNID rejects the write if the NetID already exists under a
+	// different namespace name, checking and writing atomically so this
+	// can't race with a concurrent setVNID for that other namespace.
+	if name, rejected := vmap.setVNID(netns.NetName, netns.NetID, mcEnabled); rejected {
+		klog.Warningf("Netid %d for namespace %s already exists under different namespace %s",
+			netns.NetID, netns.NetName, name)
+		return
+	}
 
 	if eventType == watch.Added {
 		vmap.policy.AddNetNamespace(netns)
@@ -240,6 +458,71 @@ func (vmap *nodeVNIDMap) handleAddOrUpdateNetNamespace(obj, _ interface{}, event
 	}
 }
 
+// handleChangePodNetworkAnnotation looks for a pending
+// pod.network.openshift.io/multitenant.change-pod-network action (join,
+// isolate, global) on netns, asks the policy to apply it, and clears the
+// annotation on success so the master knows the change took effect.
+func (vmap *nodeVNIDMap) handleChangePodNetworkAnnotation(netns *osdnv1.NetNamespace) {
+	action, args, err := common.GetChangePodNetworkAnnotation(netns)
+	if err == common.ErrorPodNetworkAnnotationNotFound {
+		return
+	} else if err != nil {
+		klog.Warningf("Error parsing pod network change annotation on namespace %q: %v", netns.NetName, err)
+		return
+	}
+
+	if err := vmap.policy.HandlePodNetworkChange(netns, action, args); err != nil {
+		klog.Warningf("Error handling pod network change (%s) for namespace %q: %v", action, netns.NetName, err)
+		return
+	}
+
+	if err := vmap.clearChangePodNetworkAnnotation(netns.NetName, action, args); err != nil {
+		klog.Warningf("Error clearing pod network change annotation on namespace %q: %v", netns.NetName, err)
+	}
+}
+
+// clearChangePodNetworkAnnotation removes the change-pod-network
+// annotation once it has been applied, retrying with backoff the same way
+// WaitAndGetVNID retries a VNID lookup, since this races with the master
+// possibly setting a newer annotation value. It only clears the annotation
+// if it still holds the (action, args) that were actually applied: if the
+// master has since written a newer action, clearing it here would make
+// that newer action silently vanish without ever being handled.
+func (vmap *nodeVNIDMap) clearChangePodNetworkAnnotation(name, wantAction, wantArgs string) error {
+	backoff := utilwait.Backoff{
+		Duration: 100 * time.Millisecond,
+		Factor:   2,
+		Steps:    5,
+	}
+	return utilwait.ExponentialBackoff(backoff, func() (bool, error) {
+		cur, err := vmap.osdnClient.NetworkV1().NetNamespaces().Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		curAction, curArgs, err := common.GetChangePodNetworkAnnotation(cur)
+		if err == common.ErrorPodNetworkAnnotationNotFound {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+		if curAction != wantAction || curArgs != wantArgs {
+			// The master has already written a newer pending action; leave
+			// it alone so it still gets handled on its own event.
+			return true, nil
+		}
+
+		delete(cur.Annotations, osdnv1.ChangePodNetworkAnnotation)
+		if _, err := vmap.osdnClient.NetworkV1().NetNamespaces().Update(context.TODO(), cur, metav1.UpdateOptions{}); err != nil {
+			if apierrors.IsConflict(err) {
+				// Someone else updated the NetNamespace; re-fetch and retry.
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	})
+}
+
 func (vmap *nodeVNIDMap) handleDeleteNetNamespace(obj interface{}) {
 	netns := obj.(*osdnv1.NetNamespace)
 	klog.V(5).Infof("Watch %s event for NetNamespace %q", watch.Deleted, netns.Name)
@@ -0,0 +1,137 @@
+package node
+
+import (
+	"context"
+	"testing"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	osdnfake "github.com/openshift/client-go/network/clientset/versioned/fake"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	ktesting "k8s.io/client-go/testing"
+)
+
+var netNamespaceResource = schema.GroupResource{Group: "network.openshift.io", Resource: "netnamespaces"}
+
+// TestHandleAddOrUpdateNetNamespaceAppliesAnnotationOnNoOpUpdate is a
+// regression test for the ordering bug: the change-pod-network annotation
+// must be handled even when the update that carries it doesn't touch NetID
+// or the multicast flag, because that's the only event it ever arrives on.
+func TestHandleAddOrUpdateNetNamespaceAppliesAnnotationOnNoOpUpdate(t *testing.T) {
+	policy := &fakePolicy{}
+	netns := &osdnv1.NetNamespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "ns1"},
+		NetName:    "ns1",
+		NetID:      10,
+		Annotations: map[string]string{
+			osdnv1.ChangePodNetworkAnnotation: "isolate",
+		},
+	}
+	client := osdnfake.NewSimpleClientset(netns.DeepCopy())
+	vmap := newNodeVNIDMap(policy, client, "")
+	vmap.setVNID(netns.NetName, netns.NetID, false)
+
+	vmap.handleAddOrUpdateNetNamespace(netns, nil, watch.Modified)
+
+	if calls := policy.podNetworkChangeCalls(); calls != 1 {
+		t.Fatalf("expected HandlePodNetworkChange to be called once despite NetID/mcEnabled being unchanged, got %d calls", calls)
+	}
+
+	got, err := client.NetworkV1().NetNamespaces().Get(context.TODO(), "ns1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if _, ok := got.Annotations[osdnv1.ChangePodNetworkAnnotation]; ok {
+		t.Fatalf("expected the annotation to be cleared after a successful HandlePodNetworkChange, got %v", got.Annotations)
+	}
+}
+
+// TestClearChangePodNetworkAnnotationLeavesNewerActionAlone covers the
+// value-match fix: if the master has already written a newer pending
+// action by the time the clear Update would land, the older action must
+// not be cleared out from under it.
+func TestClearChangePodNetworkAnnotationLeavesNewerActionAlone(t *testing.T) {
+	policy := &fakePolicy{}
+	// The live object already carries a newer action ("isolate") than the
+	// one this node is in the middle of applying ("join") -- e.g. the
+	// informer delivered the "join" event, but the master has since moved
+	// on before this node's clear Update could land.
+	client := osdnfake.NewSimpleClientset(&osdnv1.NetNamespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "ns1"},
+		NetName:    "ns1",
+		Annotations: map[string]string{
+			osdnv1.ChangePodNetworkAnnotation: "isolate",
+		},
+	})
+	vmap := newNodeVNIDMap(policy, client, "")
+
+	staleNetns := &osdnv1.NetNamespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "ns1"},
+		NetName:    "ns1",
+		Annotations: map[string]string{
+			osdnv1.ChangePodNetworkAnnotation: "join",
+		},
+	}
+	vmap.handleChangePodNetworkAnnotation(staleNetns)
+
+	if calls := policy.podNetworkChangeCalls(); calls != 1 {
+		t.Fatalf("expected HandlePodNetworkChange to be called once, got %d", calls)
+	}
+
+	got, err := client.NetworkV1().NetNamespaces().Get(context.TODO(), "ns1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Annotations[osdnv1.ChangePodNetworkAnnotation] != "isolate" {
+		t.Fatalf("expected the newer pending action to survive, got %v", got.Annotations)
+	}
+}
+
+// TestClearChangePodNetworkAnnotationRetriesOnConflict covers the backoff
+// retry loop: a Conflict on the clearing Update must be retried, not
+// treated as a permanent failure that leaves the annotation (and the
+// master's view that it's still pending) stuck.
+func TestClearChangePodNetworkAnnotationRetriesOnConflict(t *testing.T) {
+	policy := &fakePolicy{}
+	client := osdnfake.NewSimpleClientset(&osdnv1.NetNamespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "ns1"},
+		NetName:    "ns1",
+		Annotations: map[string]string{
+			osdnv1.ChangePodNetworkAnnotation: "join",
+		},
+	})
+
+	conflicts := 2
+	client.PrependReactor("update", "netnamespaces", func(action ktesting.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			conflicts--
+			return true, nil, apierrors.NewConflict(netNamespaceResource, "ns1", errTestHandlePodNetworkChange)
+		}
+		return false, nil, nil
+	})
+
+	vmap := newNodeVNIDMap(policy, client, "")
+	netns := &osdnv1.NetNamespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "ns1"},
+		NetName:    "ns1",
+		Annotations: map[string]string{
+			osdnv1.ChangePodNetworkAnnotation: "join",
+		},
+	}
+
+	vmap.handleChangePodNetworkAnnotation(netns)
+
+	if conflicts != 0 {
+		t.Fatalf("expected the retry loop to exhaust the simulated conflicts, %d left", conflicts)
+	}
+	got, err := client.NetworkV1().NetNamespaces().Get(context.TODO(), "ns1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if _, ok := got.Annotations[osdnv1.ChangePodNetworkAnnotation]; ok {
+		t.Fatalf("expected the annotation to eventually be cleared after retrying past the conflicts, got %v", got.Annotations)
+	}
+}
@@ -0,0 +1,55 @@
+package node
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentSetGetUnsetVNID hammers the sharded map from many
+// goroutines across a handful of namespaces so `go test -race` can catch
+// any lock ordering mistake between a shard's mu and nsLock.
+func TestConcurrentSetGetUnsetVNID(t *testing.T) {
+	vmap := newNodeVNIDMap(&fakePolicy{}, nil, "")
+
+	const namespaces = 8
+	const goroutines = 16
+	const iterations = 200
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				name := fmt.Sprintf("ns%d", (g+i)%namespaces)
+				id := uint32(i%namespaces) + 1
+
+				vmap.setVNID(name, id, i%2 == 0)
+				vmap.getVNID(name)
+				vmap.getMCEnabled(name)
+				vmap.GetNamespaces(id)
+				vmap.GetMulticastEnabled(id)
+				vmap.InUseVNIDs()
+				if i%7 == 0 {
+					vmap.unsetVNID(name)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func BenchmarkConcurrentSetGetVNID(b *testing.B) {
+	vmap := newNodeVNIDMap(&fakePolicy{}, nil, "")
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			name := fmt.Sprintf("ns%d", i%32)
+			vmap.setVNID(name, uint32(i%32)+1, false)
+			vmap.getVNID(name)
+			i++
+		}
+	})
+}
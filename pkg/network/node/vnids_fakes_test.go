@@ -0,0 +1,59 @@
+package node
+
+import (
+	"errors"
+	"sync"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+// errTestHandlePodNetworkChange is a sentinel error for tests in this
+// package. The conflict test uses it as the cause of its simulated
+// Conflict; fakePolicy.HandlePodNetworkChange returns whatever a test sets
+// in handlePodNetworkChangeErr, and a non-nil error there means the caller
+// skips clearing the annotation.
+var errTestHandlePodNetworkChange = errors.New("test: HandlePodNetworkChange failed")
+
+// fakePolicy is a minimal osdnPolicy stand-in for tests in this package.
+// It only implements the methods nodeVNIDMap actually calls; it does not
+// attempt to model real multitenant/networkpolicy flow programming.
+type fakePolicy struct {
+	mu sync.Mutex
+
+	allowDuplicateNetID       bool
+	podNetworkChanges         int
+	handlePodNetworkChangeErr error
+	reconciledInUse           map[uint32]bool
+}
+
+func (p *fakePolicy) AllowDuplicateNetID() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.allowDuplicateNetID
+}
+
+func (p *fakePolicy) AddNetNamespace(netns *osdnv1.NetNamespace) {}
+
+func (p *fakePolicy) UpdateNetNamespace(netns *osdnv1.NetNamespace, oldNetID uint32) {}
+
+func (p *fakePolicy) DeleteNetNamespace(netns *osdnv1.NetNamespace) {}
+
+func (p *fakePolicy) HandlePodNetworkChange(netns *osdnv1.NetNamespace, action, args string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.podNetworkChanges++
+	return p.handlePodNetworkChangeErr
+}
+
+func (p *fakePolicy) podNetworkChangeCalls() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.podNetworkChanges
+}
+
+func (p *fakePolicy) ReconcileVNIDFlows(inUse map[uint32]bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reconciledInUse = inUse
+	return nil
+}
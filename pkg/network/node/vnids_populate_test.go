@@ -0,0 +1,115 @@
+package node
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	osdnfake "github.com/openshift/client-go/network/clientset/versioned/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ktesting "k8s.io/client-go/testing"
+)
+
+// TestPopulateVNIDsReconcilesStaleCacheEntry drives the actual populateVNIDs
+// method (not a hand-copied stand-in) against a fake osdnClient, simulating
+// a node that restarted with a namespace deleted while it was disconnected:
+// the namespace was seeded from the on-disk cache, but the fresh List no
+// longer includes it.
+func TestPopulateVNIDsReconcilesStaleCacheEntry(t *testing.T) {
+	client := osdnfake.NewSimpleClientset(&osdnv1.NetNamespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "kept-ns"},
+		NetID:      9,
+	})
+
+	vmap := newNodeVNIDMap(&fakePolicy{}, client, "")
+	// Simulate a cache-seeded entry for a namespace that was deleted while
+	// the node was disconnected; populateVNIDs's List won't return it.
+	vmap.setVNID("deleted-ns", 5, false)
+
+	if err := vmap.populateVNIDs(); err != nil {
+		t.Fatalf("populateVNIDs: %v", err)
+	}
+
+	if id, err := vmap.getVNID("kept-ns"); err != nil || id != 9 {
+		t.Fatalf("expected kept-ns to have VNID 9, got %d, %v", id, err)
+	}
+	if _, err := vmap.getVNID("deleted-ns"); err == nil {
+		t.Fatalf("expected deleted-ns to have been reconciled away")
+	}
+	if inUse := vmap.InUseVNIDs(); inUse[5] {
+		t.Fatalf("expected VNID 5 to no longer be reported in-use, got %v", inUse)
+	}
+}
+
+// TestPopulateVNIDsReturnsListError covers the offline-restart case: if the
+// apiserver can't be reached, populateVNIDs must surface the List error
+// rather than silently wiping whatever the cache seeded.
+func TestPopulateVNIDsReturnsListError(t *testing.T) {
+	client := osdnfake.NewSimpleClientset()
+	wantErr := fmt.Errorf("connection refused")
+	client.PrependReactor("list", "netnamespaces", func(action ktesting.Action) (bool, runtime.Object, error) {
+		return true, nil, wantErr
+	})
+
+	vmap := newNodeVNIDMap(&fakePolicy{}, client, "")
+	vmap.setVNID("cached-ns", 5, false)
+
+	if err := vmap.populateVNIDs(); err == nil {
+		t.Fatalf("expected populateVNIDs to return the List error")
+	}
+
+	// The cache-seeded entry must survive a failed List: populateVNIDs only
+	// reconciles stale entries once it has a successful List to compare
+	// against.
+	if id, err := vmap.getVNID("cached-ns"); err != nil || id != 5 {
+		t.Fatalf("expected cached-ns to still have VNID 5 after a failed List, got %d, %v", id, err)
+	}
+}
+
+func TestPopulateVNIDsWarnsOnDuplicateNetID(t *testing.T) {
+	client := osdnfake.NewSimpleClientset(
+		&osdnv1.NetNamespace{ObjectMeta: metav1.ObjectMeta{Name: "ns1"}, NetID: 10},
+		&osdnv1.NetNamespace{ObjectMeta: metav1.ObjectMeta{Name: "ns2"}, NetID: 10},
+	)
+
+	vmap := newNodeVNIDMap(&fakePolicy{}, client, "")
+	if err := vmap.populateVNIDs(); err != nil {
+		t.Fatalf("populateVNIDs: %v", err)
+	}
+
+	// Exactly one of the two namespaces wins the colliding NetID; the other
+	// must have no VNID recorded rather than a corrupted entry.
+	_, err1 := vmap.getVNID("ns1")
+	_, err2 := vmap.getVNID("ns2")
+	if (err1 == nil) == (err2 == nil) {
+		t.Fatalf("expected exactly one of ns1/ns2 to hold netid 10, got err1=%v err2=%v", err1, err2)
+	}
+}
+
+// TestSaveCacheDebouncedWritePersistsBurst covers the runCacheWriter: after
+// a burst of setVNID calls (as populateVNIDs does once per namespace at
+// startup) and the flush delay, the debounced write must have persisted
+// every namespace of the burst. It does not count how many writes ran.
+func TestSaveCacheDebouncedWritePersistsBurst(t *testing.T) {
+	dir := t.TempDir()
+	vmap := newNodeVNIDMap(&fakePolicy{}, nil, dir)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go vmap.runCacheWriter(stopCh)
+
+	for i := 0; i < 50; i++ {
+		vmap.setVNID(fmt.Sprintf("ns%d", i), uint32(i+1), false)
+	}
+
+	// Give the debounce timer time to fire exactly once.
+	time.Sleep(vnidCacheFlushDelay * 3)
+
+	restarted := newNodeVNIDMap(&fakePolicy{}, nil, dir)
+	restarted.loadCache()
+	if n := restarted.count(); n != 50 {
+		t.Fatalf("expected the debounced write to have persisted all 50 namespaces, got %d", n)
+	}
+}
@@ -0,0 +1,192 @@
+package node
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// vnidCacheFlushDelay is how long the cache writer waits after being
+// marked dirty before it actually writes, so a burst of setVNID/unsetVNID
+// calls (e.g. populateVNIDs seeding N namespaces at startup) collapses
+// into a single write instead of one per call.
+const vnidCacheFlushDelay = 250 * time.Millisecond
+
+// vnidCacheSchemaVersion must be bumped whenever the on-disk format of
+// vnidCacheFile changes incompatibly; loadCache ignores a cache file
+// written by an older or newer schema rather than risk misinterpreting it.
+const vnidCacheSchemaVersion = 1
+
+const vnidCacheFileName = "vnidmap.json"
+
+func vnidCachePath(runDir string) string {
+	return filepath.Join(runDir, vnidCacheFileName)
+}
+
+// vnidCacheEntry is the persisted form of one namespace's VNID.
+type vnidCacheEntry struct {
+	NetID     uint32 `json:"netID"`
+	MCEnabled bool   `json:"mcEnabled"`
+}
+
+// vnidCacheFile is the on-disk representation of a nodeVNIDMap, used to
+// seed the map before the NetNamespace informer has synced so pod and
+// service setup isn't blocked on API server availability after a restart.
+type vnidCacheFile struct {
+	SchemaVersion int                       `json:"schemaVersion"`
+	Namespaces    map[string]vnidCacheEntry `json:"namespaces"`
+	Checksum      string                    `json:"checksum"`
+}
+
+// vnidCacheChecksum computes a deterministic checksum over the namespace
+// entries so a truncated or corrupted write can be detected and ignored.
+func vnidCacheChecksum(namespaces map[string]vnidCacheEntry) string {
+	names := make([]string, 0, len(namespaces))
+	for name := range namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		entry := namespaces[name]
+		fmt.Fprintf(h, "%s=%d,%v\n", name, entry.NetID, entry.MCEnabled)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// saveCache marks the cache dirty so the cache writer goroutine persists
+// it shortly, without blocking the setVNID/unsetVNID caller on a
+// synchronous write-and-rename. It's safe to call this on every mutation:
+// a burst of calls collapses into a single write via vnidCacheFlushDelay.
+func (vmap *nodeVNIDMap) saveCache() {
+	if vmap.cachePath == "" {
+		return
+	}
+	select {
+	case vmap.cacheDirtyCh <- struct{}{}:
+	default:
+	}
+}
+
+// runCacheWriter debounces saveCache's dirty signal and writes the cache
+// to disk at most once per vnidCacheFlushDelay until stopCh is closed. It
+// is meant to be run in its own goroutine.
+func (vmap *nodeVNIDMap) runCacheWriter(stopCh <-chan struct{}) {
+	var timer *time.Timer
+	var timerCh <-chan time.Time
+
+	for {
+		select {
+		case <-vmap.cacheDirtyCh:
+			if timer == nil {
+				timer = time.NewTimer(vnidCacheFlushDelay)
+				timerCh = timer.C
+			}
+		case <-timerCh:
+			vmap.writeCacheNow()
+			timer, timerCh = nil, nil
+		case <-stopCh:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+	}
+}
+
+// writeCacheNow persists the current name -> (netid, mcEnabled) mapping to
+// disk so a future restart can seed the map before the apiserver is
+// reachable. Errors are logged, not returned: the cache is a best-effort
+// optimization, never a requirement for correctness.
+func (vmap *nodeVNIDMap) writeCacheNow() {
+	namespaces := make(map[string]vnidCacheEntry)
+	for _, shard := range vmap.shards {
+		shard.mu.RLock()
+		for name, id := range shard.ids {
+			namespaces[name] = vnidCacheEntry{NetID: id, MCEnabled: shard.mcEnabled[name]}
+		}
+		shard.mu.RUnlock()
+	}
+
+	file := vnidCacheFile{
+		SchemaVersion: vnidCacheSchemaVersion,
+		Namespaces:    namespaces,
+		Checksum:      vnidCacheChecksum(namespaces),
+	}
+
+	data, err := json.Marshal(&file)
+	if err != nil {
+		klog.Warningf("Failed to marshal VNID cache: %v", err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(vmap.cachePath), 0755); err != nil {
+		klog.Warningf("Failed to create VNID cache directory: %v", err)
+		return
+	}
+
+	// Write to a temp file and rename so a crash mid-write never leaves a
+	// truncated cache file behind for the next loadCache to trip over.
+	tmp := vmap.cachePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		klog.Warningf("Failed to write VNID cache: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, vmap.cachePath); err != nil {
+		klog.Warningf("Failed to install VNID cache: %v", err)
+	}
+}
+
+// loadCache reads a previously-saved VNID cache from disk and seeds the
+// in-memory map from it. A missing, corrupt, or schema-mismatched cache is
+// treated as empty: it's always safe to fall back to the normal populateVNIDs
+// LIST, just without the fast-start benefit.
+func (vmap *nodeVNIDMap) loadCache() {
+	if vmap.cachePath == "" {
+		return
+	}
+
+	data, err := os.ReadFile(vmap.cachePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Warningf("Failed to read VNID cache: %v", err)
+		}
+		return
+	}
+
+	var file vnidCacheFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		klog.Warningf("Ignoring corrupt VNID cache: %v", err)
+		return
+	}
+	if file.SchemaVersion != vnidCacheSchemaVersion {
+		klog.Warningf("Ignoring VNID cache with unsupported schema version %d", file.SchemaVersion)
+		return
+	}
+	if file.Checksum != vnidCacheChecksum(file.Namespaces) {
+		klog.Warningf("Ignoring VNID cache that failed its integrity check")
+		return
+	}
+
+	vmap.nsLock.Lock()
+	defer vmap.nsLock.Unlock()
+	for name, entry := range file.Namespaces {
+		shard := vmap.shardFor(name)
+		shard.mu.Lock()
+		shard.ids[name] = entry.NetID
+		shard.mcEnabled[name] = entry.MCEnabled
+		shard.mu.Unlock()
+
+		vmap.addNamespaceToSet(name, entry.NetID)
+		vmap.indexer.update(name, entry.NetID, entry.MCEnabled)
+	}
+	klog.V(2).Infof("Seeded VNID map from cache with %d namespaces", len(file.Namespaces))
+}
@@ -0,0 +1,97 @@
+package node
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+// TestCacheSeedsMapForOfflineRestart is the offline-tolerant-restart
+// scenario chunk0-2 targets: a node restarts with the apiserver
+// unreachable, and getVNID must still succeed immediately by seeding
+// purely from the on-disk cache, before any LIST ever runs.
+func TestCacheSeedsMapForOfflineRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	vmap := newNodeVNIDMap(&fakePolicy{}, nil, dir)
+	vmap.setVNID("ns1", 7, true)
+	vmap.writeCacheNow()
+
+	restarted := newNodeVNIDMap(&fakePolicy{}, nil, dir)
+	restarted.loadCache()
+
+	id, err := restarted.getVNID("ns1")
+	if err != nil || id != 7 {
+		t.Fatalf("expected cached VNID 7 for ns1, got %d, %v", id, err)
+	}
+	if !restarted.getMCEnabled("ns1") {
+		t.Fatalf("expected mcEnabled to be seeded from cache")
+	}
+}
+
+func TestLoadCacheIgnoresCorruptFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(vnidCachePath(dir), []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	vmap := newNodeVNIDMap(&fakePolicy{}, nil, dir)
+	vmap.loadCache()
+
+	if n := vmap.count(); n != 0 {
+		t.Fatalf("expected corrupt cache to be ignored, got %d entries", n)
+	}
+}
+
+func TestLoadCacheIgnoresBadChecksum(t *testing.T) {
+	dir := t.TempDir()
+	file := vnidCacheFile{
+		SchemaVersion: vnidCacheSchemaVersion,
+		Namespaces:    map[string]vnidCacheEntry{"ns1": {NetID: 7}},
+		Checksum:      "not-the-real-checksum",
+	}
+	data, err := json.Marshal(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(vnidCachePath(dir), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	vmap := newNodeVNIDMap(&fakePolicy{}, nil, dir)
+	vmap.loadCache()
+
+	if n := vmap.count(); n != 0 {
+		t.Fatalf("expected cache with a bad checksum to be ignored, got %d entries", n)
+	}
+}
+
+func TestLoadCacheIgnoresUnsupportedSchemaVersion(t *testing.T) {
+	dir := t.TempDir()
+	namespaces := map[string]vnidCacheEntry{"ns1": {NetID: 7}}
+	file := vnidCacheFile{
+		SchemaVersion: vnidCacheSchemaVersion + 1,
+		Namespaces:    namespaces,
+		Checksum:      vnidCacheChecksum(namespaces),
+	}
+	data, err := json.Marshal(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(vnidCachePath(dir), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	vmap := newNodeVNIDMap(&fakePolicy{}, nil, dir)
+	vmap.loadCache()
+
+	if n := vmap.count(); n != 0 {
+		t.Fatalf("expected cache with an unsupported schema version to be ignored, got %d entries", n)
+	}
+}
+
+// The stale-cache-entry reconciliation itself (populateVNIDs diffing
+// knownNames against a real List) is covered by
+// TestPopulateVNIDsReconcilesStaleCacheEntry in vnids_populate_test.go,
+// which drives populateVNIDs against a fake osdnClient instead of
+// hand-copying its diff loop.